@@ -4,32 +4,122 @@ import (
 	"fmt"
 	"github.com/robfig/revel"
 	"go/build"
+	"golang.org/x/tools/go/vcs"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strconv"
+	"strings"
 	"text/template"
 )
 
 var importErrorPattern = regexp.MustCompile("import \"([^\"]+)\": cannot find package")
 
+// Dependency resolution strategies for "go build", selected via the
+// build.mode app.conf setting (or auto-detected when unset).
+const (
+	buildModeGopath = "gopath"
+	buildModeMod    = "mod"
+	buildModeVendor = "vendor"
+)
+
+// resolveBuildMode determines how "go build" should resolve dependencies.
+// An explicit build.mode setting always wins; otherwise it auto-detects a
+// go.mod or vendor/ directory at the app root and falls back to the
+// legacy GOPATH behavior.
+func resolveBuildMode() string {
+	if mode, found := revel.Config.String("build.mode"); found {
+		return mode
+	}
+	if _, err := os.Stat(path.Join(revel.BasePath, "go.mod")); err == nil {
+		return buildModeMod
+	}
+	if info, err := os.Stat(path.Join(revel.BasePath, "vendor")); err == nil && info.IsDir() {
+		return buildModeVendor
+	}
+	return buildModeGopath
+}
+
+// buildEnviron returns the environment for the "go build"/"go get"
+// subprocesses, threading GOFLAGS/GOPROXY through from app.conf so module
+// builds can reach private proxies.
+func buildEnviron() []string {
+	env := os.Environ()
+	if goFlags, found := revel.Config.String("build.goflags"); found {
+		env = append(env, "GOFLAGS="+goFlags)
+	}
+	if goProxy, found := revel.Config.String("build.goproxy"); found {
+		env = append(env, "GOPROXY="+goProxy)
+	}
+	return env
+}
+
+// VersionResolver resolves the version string embedded into the binary via
+// -ldflags when build.reproducible is enabled. The default resolver tries,
+// in order, the build.version app.conf setting, the REVEL_BUILD_VERSION
+// environment variable, and finally "git describe".
+type VersionResolver func() string
+
+// BuildVersionResolver is the VersionResolver used by Build. It may be
+// overridden to plug in a custom versioning scheme.
+var BuildVersionResolver VersionResolver = resolveVersion
+
+func resolveVersion() string {
+	if v, found := revel.Config.String("build.version"); found && v != "" {
+		return v
+	}
+	if v := os.Getenv("REVEL_BUILD_VERSION"); v != "" {
+		return v
+	}
+	out, err := exec.Command("git", "describe", "--tags", "--always", "--dirty").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// gcLdflags assembles the -ldflags value for a reproducible "go build": it
+// strips the build ID and symbol table and injects the resolved version via
+// -X when build.reproducible is set, and appends any user-supplied
+// build.ldflags regardless. gccgoBuilder has its own variant, since gccgo's
+// -gccgoflags doesn't understand gc's -buildid=/-X syntax.
+func gcLdflags(reproducible bool) string {
+	var parts []string
+	if reproducible {
+		parts = append(parts, "-buildid=", "-s", "-w")
+	}
+	if custom, found := revel.Config.String("build.ldflags"); found && custom != "" {
+		parts = append(parts, custom)
+	}
+	if reproducible {
+		if version := BuildVersionResolver(); version != "" {
+			parts = append(parts, fmt.Sprintf("-X %s/app.APP_VERSION=%s", revel.ImportPath, version))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
 // Build the app:
 // 1. Generate the the main.go file.
 // 2. Run the appropriate "go build" command.
 // Requires that revel.Init has been called previously.
-// Returns the path to the built binary, and an error if there was a problem building it.
-func Build() (app *App, compileError *revel.Error) {
-	sourceInfo, compileError := ProcessSource(revel.CodePaths)
+// Returns the built App, and a CompileError aggregating
+// every diagnostic if there was a problem building it.
+func Build() (app *App, compileErrors *CompileError) {
+	sourceInfo, compileError := processSourceCached(revel.CodePaths)
 	if compileError != nil {
-		return nil, compileError
+		return nil, &CompileError{Errs: []*revel.Error{compileError}}
 	}
 
-	// Add the db.import to the import paths.
+	// Add the db.import to the import paths. Append onto a copy: InitImportPaths
+	// may be backed by a cached package's slice, and appending in place could
+	// grow that shared backing array on every rebuild.
 	if dbImportPath, found := revel.Config.String("db.import"); found {
-		sourceInfo.InitImportPaths = append(sourceInfo.InitImportPaths, dbImportPath)
+		importPaths := make([]string, len(sourceInfo.InitImportPaths), len(sourceInfo.InitImportPaths)+1)
+		copy(importPaths, sourceInfo.InitImportPaths)
+		sourceInfo.InitImportPaths = append(importPaths, dbImportPath)
 	}
 
 	tmpl := template.Must(template.New("").Parse(REGISTER_CONTROLLERS))
@@ -40,36 +130,46 @@ func Build() (app *App, compileError *revel.Error) {
 		"TestSuites":     sourceInfo.TestSuites,
 	})
 
-	// Create a fresh temp dir.
+	// With build.reproducible set, the gc builder passes -trimpath (see
+	// gcBuilder.Args), so tmp/'s absolute location is not recorded in the
+	// compiled binary's source paths. Other builds, including gccgo ones,
+	// record it.
 	tmpPath := path.Join(revel.AppPath, "tmp")
-	err := os.RemoveAll(tmpPath)
-	if err != nil {
-		revel.ERROR.Println("Failed to remove tmp dir:", err)
-	}
-	err = os.Mkdir(tmpPath, 0777)
-	if err != nil {
-		revel.ERROR.Fatalf("Failed to make tmp directory: %v", err)
-	}
+	mainGoPath := path.Join(tmpPath, "main.go")
+
+	// Only rewrite tmp/ when the generated main.go actually differs from
+	// the last build; re-wiping it on every watched rebuild is what made
+	// dev-mode reloads slow.
+	if _, err := os.Stat(mainGoPath); err == nil && registerControllerSource == buildCache.mainGoSource {
+		revel.TRACE.Println("Generated main.go unchanged, reusing tmp dir")
+	} else {
+		if err := os.RemoveAll(tmpPath); err != nil {
+			revel.ERROR.Println("Failed to remove tmp dir:", err)
+		}
+		if err := os.Mkdir(tmpPath, 0777); err != nil {
+			revel.ERROR.Fatalf("Failed to make tmp directory: %v", err)
+		}
 
-	// Create the main.go file
-	controllersFile, err := os.Create(path.Join(tmpPath, "main.go"))
-	defer controllersFile.Close()
-	if err != nil {
-		revel.ERROR.Fatalf("Failed to create main.go: %v", err)
-	}
-	_, err = controllersFile.WriteString(registerControllerSource)
-	if err != nil {
-		revel.ERROR.Fatalf("Failed to write to main.go: %v", err)
+		controllersFile, err := os.Create(mainGoPath)
+		defer controllersFile.Close()
+		if err != nil {
+			revel.ERROR.Fatalf("Failed to create main.go: %v", err)
+		}
+		if _, err = controllersFile.WriteString(registerControllerSource); err != nil {
+			revel.ERROR.Fatalf("Failed to write to main.go: %v", err)
+		}
+		buildCache.mainGoSource = registerControllerSource
 	}
 
 	// Read build config.
 	buildTags := revel.Config.StringDefault("build.tags", "")
 
-	// Build the user program (all code under app).
-	// It relies on the user having "go" installed.
-	goPath, err := exec.LookPath("go")
+	// Build the user program (all code under app) using the configured
+	// toolchain.
+	builder := resolveBuilder()
+	toolPath, err := builder.Command()
 	if err != nil {
-		revel.ERROR.Fatalf("Go executable not found in PATH.")
+		revel.ERROR.Fatalf("Build tool not found in PATH.")
 	}
 
 	ctx := build.Default
@@ -77,16 +177,32 @@ func Build() (app *App, compileError *revel.Error) {
 	if err != nil {
 		revel.ERROR.Fatalln("Failure importing", revel.ImportPath)
 	}
-	binName := path.Join(pkg.BinDir, path.Base(revel.BasePath))
-	if runtime.GOOS == "windows" {
-		binName += ".exe"
-	}
+	target := resolveTarget()
+	binName := builder.BinName(path.Join(pkg.BinDir, path.Base(revel.BasePath)), target)
+
+	buildMode := resolveBuildMode()
+	buildEnv := builder.Env(buildEnviron(), target)
+	reproducible := revel.Config.BoolDefault("build.reproducible", false)
+	ldflags := builder.Ldflags(reproducible)
+	pkgPath := path.Join(revel.ImportPath, "app", "tmp")
+
+	// The vcs-fetch retry loop only makes sense under the "gc" toolchain in
+	// GOPATH mode; modules, vendored trees, and other toolchains resolve
+	// their own dependencies.
+	_, isGC := builder.(gcBuilder)
+	retryFetch := isGC && buildMode == buildModeGopath
+
+	// Tracks repo roots (not leaf packages) we've already fetched, so a
+	// repo that exposes many subpackages doesn't trigger a fetch per
+	// subpackage and can't loop forever.
+	attemptedRoots := make(map[string]struct{})
+	fetchEnv := vcsAuthEnv(append([]string{}, buildEnv...))
 
-	gotten := make(map[string]struct{})
 	for {
-		buildCmd := exec.Command(goPath, "build",
-			"-tags", buildTags,
-			"-o", binName, path.Join(revel.ImportPath, "app", "tmp"))
+		args := builder.Args(pkgPath, binName, buildTags, ldflags, reproducible, buildMode)
+
+		buildCmd := exec.Command(toolPath, args...)
+		buildCmd.Env = buildEnv
 		revel.TRACE.Println("Exec:", buildCmd.Args)
 		output, err := buildCmd.CombinedOutput()
 
@@ -96,29 +212,54 @@ func Build() (app *App, compileError *revel.Error) {
 		}
 		revel.TRACE.Println(string(output))
 
-		// See if it was an import error that we can go get.
-		matches := importErrorPattern.FindStringSubmatch(string(output))
-		if matches == nil {
-			return nil, newCompileError(output)
+		if !retryFetch {
+			return nil, newCompileErrors(output)
 		}
 
-		// Ensure we haven't already tried to go get it.
-		pkgName := matches[1]
-		if _, alreadyTried := gotten[pkgName]; alreadyTried {
-			return nil, newCompileError(output)
+		imports := missingImports(output)
+		if len(imports) == 0 {
+			return nil, newCompileErrors(output)
 		}
-		gotten[pkgName] = struct{}{}
 
-		// Execute "go get <pkg>"
-		getCmd := exec.Command(goPath, "get", pkgName)
-		revel.TRACE.Println("Exec:", getCmd.Args)
-		getOutput, err := getCmd.CombinedOutput()
-		if err != nil {
-			revel.TRACE.Println(string(getOutput))
-			return nil, newCompileError(output)
+		var unresolved []string
+		fetchedAny := false
+		for _, importPath := range imports {
+			root, vcsErr := vcs.RepoRootForImportPath(importPath, false)
+			rootName := importPath
+			if vcsErr == nil {
+				rootName = root.Root
+			}
+
+			if _, alreadyTried := attemptedRoots[rootName]; alreadyTried {
+				continue
+			}
+			attemptedRoots[rootName] = struct{}{}
+
+			if vcsErr != nil {
+				revel.TRACE.Println("Failed to resolve VCS root for", importPath, ":", vcsErr)
+				unresolved = append(unresolved, importPath)
+				continue
+			}
+
+			if _, fetchErr := fetchImport(importPath, fetchEnv); fetchErr != nil {
+				revel.TRACE.Println("Failed to fetch", rootName, ":", fetchErr)
+				unresolved = append(unresolved, importPath)
+				continue
+			}
+			fetchedAny = true
 		}
 
-		// Success getting the import, attempt to build again.
+		if len(unresolved) > 0 {
+			revel.ERROR.Println("Unable to resolve imports:", strings.Join(unresolved, ", "))
+			return nil, newCompileErrors(output)
+		}
+		if !fetchedAny {
+			// Every missing import's repo root had already been attempted
+			// (and presumably failed) on a prior iteration.
+			return nil, newCompileErrors(output)
+		}
+
+		// Successfully fetched the missing imports, attempt to build again.
 	}
 	revel.ERROR.Fatalf("Not reachable")
 	return nil, nil
@@ -184,44 +325,89 @@ func containsValue(m map[string]string, val string) bool {
 	return false
 }
 
-// Parse the output of the "go build" command.
-// Return a detailed Error.
-func newCompileError(output []byte) *revel.Error {
-	errorMatch := regexp.MustCompile(`(?m)^([^:#]+):(\d+):(\d+:)? (.*)$`).
-		FindSubmatch(output)
-	if errorMatch == nil {
-		revel.ERROR.Println("Failed to parse build errors:\n", string(output))
-		return &revel.Error{
-			SourceType:  "Go code",
-			Title:       "Go Compilation Error",
-			Description: "See console for build error.",
-		}
+// compileErrorPattern matches one "file:line:col: message" diagnostic per
+// line. Requiring a non-blank, non-"#" first character excludes "# pkg"
+// header lines and indented continuation lines from matching as their own
+// diagnostic.
+var compileErrorPattern = regexp.MustCompile(`(?m)^([^:#\s][^:]*):(\d+):(\d+:)? (.*)$`)
+
+// CompileError aggregates every diagnostic produced by a single "go
+// build" invocation, so a dev-mode error page can render all of them at
+// once instead of forcing a fix-and-recompile cycle per error.
+type CompileError struct {
+	Errs []*revel.Error
+}
+
+// Errors returns every diagnostic from the failed build.
+func (e *CompileError) Errors() []*revel.Error {
+	return e.Errs
+}
+
+// Error implements the error interface by describing the first
+// diagnostic; callers that want the rest should use Errors.
+func (e *CompileError) Error() string {
+	if len(e.Errs) == 0 {
+		return "Go Compilation Error"
 	}
+	first := e.Errs[0]
+	return fmt.Sprintf("%s: %s:%d: %s", first.Title, first.Path, first.Line, first.Description)
+}
 
-	// Read the source for the offending file.
-	var (
-		relFilename    = string(errorMatch[1]) // e.g. "src/revel/sample/app/controllers/app.go"
-		absFilename, _ = filepath.Abs(relFilename)
-		line, _        = strconv.Atoi(string(errorMatch[2]))
-		description    = string(errorMatch[4])
-		compileError   = &revel.Error{
+// BuildErrors parses the full output of a "go build" invocation into one
+// *revel.Error per diagnostic, so a caller that wants to surface every
+// compile problem at once (rather than fixing and recompiling one at a
+// time) can use the complete slice instead of just the first. Diagnostics
+// whose message starts with "warning:" are tagged as such in Title rather
+// than dropped, so callers can tell them apart from hard errors.
+func BuildErrors(output []byte) []*revel.Error {
+	var errs []*revel.Error
+	for _, errorMatch := range compileErrorPattern.FindAllSubmatch(output, -1) {
+		// Read the source for the offending file.
+		var (
+			relFilename    = string(errorMatch[1]) // e.g. "src/revel/sample/app/controllers/app.go"
+			absFilename, _ = filepath.Abs(relFilename)
+			line, _        = strconv.Atoi(string(errorMatch[2]))
+			description    = string(errorMatch[4])
+			title          = "Go Compilation Error"
+		)
+		if strings.HasPrefix(strings.ToLower(description), "warning:") {
+			title = "Go Compilation Warning"
+		}
+
+		compileError := &revel.Error{
 			SourceType:  "Go code",
-			Title:       "Go Compilation Error",
+			Title:       title,
 			Path:        relFilename,
 			Description: description,
 			Line:        line,
 		}
-	)
 
-	fileStr, err := revel.ReadLines(absFilename)
-	if err != nil {
-		compileError.MetaError = absFilename + ": " + err.Error()
-		revel.ERROR.Println(compileError.MetaError)
-		return compileError
+		fileStr, err := revel.ReadLines(absFilename)
+		if err != nil {
+			compileError.MetaError = absFilename + ": " + err.Error()
+			revel.ERROR.Println(compileError.MetaError)
+		} else {
+			compileError.SourceLines = fileStr
+		}
+
+		errs = append(errs, compileError)
 	}
+	return errs
+}
 
-	compileError.SourceLines = fileStr
-	return compileError
+// newCompileErrors parses the output of a "go build" command into a
+// CompileError covering every diagnostic found.
+func newCompileErrors(output []byte) *CompileError {
+	errs := BuildErrors(output)
+	if len(errs) == 0 {
+		revel.ERROR.Println("Failed to parse build errors:\n", string(output))
+		errs = []*revel.Error{{
+			SourceType:  "Go code",
+			Title:       "Go Compilation Error",
+			Description: "See console for build error.",
+		}}
+	}
+	return &CompileError{Errs: errs}
 }
 
 const REGISTER_CONTROLLERS = `package main
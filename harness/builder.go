@@ -0,0 +1,222 @@
+package harness
+
+import (
+	"github.com/robfig/revel"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Target identifies the OS/architecture a build should produce a binary
+// for. The zero value means "build for the host".
+type Target struct {
+	GOOS   string
+	GOARCH string
+}
+
+// BuildTarget overrides the OS/architecture used to compile the app, e.g.
+// for cross-compiled release builds produced via "revel build
+// --target=linux/arm64". The zero value builds for the host. The
+// "revel build" command (outside this package) is expected to set this
+// before calling Build; resolveTarget also honors a build.target app.conf
+// setting of the same "GOOS/GOARCH" form as a config-only alternative.
+var BuildTarget Target
+
+// resolveTarget returns the target to build for: an explicit BuildTarget
+// wins, otherwise it falls back to the build.target app.conf setting.
+func resolveTarget() Target {
+	if BuildTarget.GOOS != "" || BuildTarget.GOARCH != "" {
+		return BuildTarget
+	}
+	t, found := revel.Config.String("build.target")
+	if !found || t == "" {
+		return Target{}
+	}
+	goos, goarch, ok := parseTarget(t)
+	if !ok {
+		revel.ERROR.Println("Invalid build.target", t, "- expected GOOS/GOARCH")
+		return Target{}
+	}
+	return Target{GOOS: goos, GOARCH: goarch}
+}
+
+// parseTarget splits a "GOOS/GOARCH" triple.
+func parseTarget(t string) (goos, goarch string, ok bool) {
+	parts := strings.SplitN(t, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Builder abstracts the toolchain invocation used to compile the app, so
+// alternate toolchains can be selected via the build.tool app.conf setting
+// without touching the rest of Build.
+type Builder interface {
+	// Command returns the path to the compiler executable.
+	Command() (string, error)
+
+	// Ldflags assembles the linker flags to pass to Args, in whatever
+	// syntax this toolchain's linker expects.
+	Ldflags(reproducible bool) string
+
+	// Args returns the arguments to pass to Command (excluding the
+	// executable itself) to produce binName from pkgPath.
+	Args(pkgPath, binName, buildTags, ldflags string, reproducible bool, buildMode string) []string
+
+	// BinName returns the output binary name for target, appending a
+	// platform-specific extension (e.g. ".exe" for windows) based on the
+	// target rather than the host this process happens to run on.
+	BinName(base string, target Target) string
+
+	// Env returns env with any GOOS/GOARCH/CGO_ENABLED overrides needed to
+	// produce a binary for target appended.
+	Env(env []string, target Target) []string
+}
+
+// builders maps build.tool app.conf values to their Builder.
+var builders = map[string]Builder{
+	"gc":    gcBuilder{},
+	"gccgo": gccgoBuilder{},
+}
+
+// resolveBuilder returns the Builder selected via build.tool, defaulting
+// to the standard "gc" toolchain.
+func resolveBuilder() Builder {
+	tool := revel.Config.StringDefault("build.tool", "gc")
+	if b, ok := builders[tool]; ok {
+		return b
+	}
+	revel.ERROR.Println("Unknown build.tool", tool, "- falling back to gc")
+	return gcBuilder{}
+}
+
+// gcBuilder drives the standard "go build" toolchain.
+type gcBuilder struct{}
+
+func (gcBuilder) Command() (string, error) {
+	return exec.LookPath("go")
+}
+
+func (gcBuilder) Ldflags(reproducible bool) string {
+	return gcLdflags(reproducible)
+}
+
+func (gcBuilder) Args(pkgPath, binName, buildTags, ldflags string, reproducible bool, buildMode string) []string {
+	args := []string{"build", "-tags", buildTags}
+	switch buildMode {
+	case buildModeVendor:
+		args = append(args, "-mod=vendor")
+	case buildModeMod:
+		args = append(args, "-mod=mod")
+	}
+	if reproducible {
+		args = append(args, "-trimpath")
+	}
+	if ldflags != "" {
+		args = append(args, "-ldflags", ldflags)
+	}
+	return append(args, "-o", binName, pkgPath)
+}
+
+func (gcBuilder) BinName(base string, target Target) string {
+	if targetGOOS(target) == "windows" {
+		return base + ".exe"
+	}
+	return base
+}
+
+func (gcBuilder) Env(env []string, target Target) []string {
+	return targetEnv(env, target)
+}
+
+// gccgoBuilder drives the gccgo toolchain, for users who need its
+// alternate code generation (e.g. for platforms gc doesn't target). It
+// still goes through "go build" (with -compiler=gccgo) rather than
+// invoking gccgo directly, so the app's imports are resolved and linked
+// the same way the gc builder does.
+type gccgoBuilder struct{}
+
+func (gccgoBuilder) Command() (string, error) {
+	return exec.LookPath("go")
+}
+
+// Ldflags deliberately skips the gc-only -buildid=/-s/-w/-X flags gcLdflags
+// produces: gccgo's -gccgoflags passes its value straight to the gccgo
+// driver, which doesn't understand gc's linker syntax. Only the user's own
+// build.ldflags (assumed to already be gccgo-compatible) is forwarded.
+func (gccgoBuilder) Ldflags(reproducible bool) string {
+	custom, _ := revel.Config.String("build.ldflags")
+	return custom
+}
+
+func (gccgoBuilder) Args(pkgPath, binName, buildTags, ldflags string, reproducible bool, buildMode string) []string {
+	args := []string{"build", "-compiler=gccgo", "-tags", buildTags}
+	switch buildMode {
+	case buildModeVendor:
+		args = append(args, "-mod=vendor")
+	case buildModeMod:
+		args = append(args, "-mod=mod")
+	}
+	if ldflags != "" {
+		args = append(args, "-gccgoflags", ldflags)
+	}
+	return append(args, "-o", binName, pkgPath)
+}
+
+func (gccgoBuilder) BinName(base string, target Target) string {
+	if targetGOOS(target) == "windows" {
+		return base + ".exe"
+	}
+	return base
+}
+
+func (gccgoBuilder) Env(env []string, target Target) []string {
+	return targetEnv(env, target)
+}
+
+// targetGOOS returns the effective GOOS for target, defaulting to the host.
+func targetGOOS(target Target) string {
+	if target.GOOS != "" {
+		return target.GOOS
+	}
+	return runtime.GOOS
+}
+
+// targetEnv sets GOOS/GOARCH/CGO_ENABLED overrides in env for cross-compiling
+// to target, replacing rather than appending any existing values so the
+// build doesn't end up with duplicate, order-dependent entries for the same
+// key. Cross-compiled builds disable cgo by default, since a cross cgo
+// toolchain is rarely available, but build.cgo in app.conf can override
+// that.
+func targetEnv(env []string, target Target) []string {
+	if target.GOOS == "" && target.GOARCH == "" {
+		return env
+	}
+	cgoEnabled := "0"
+	if revel.Config.BoolDefault("build.cgo", false) {
+		cgoEnabled = "1"
+	}
+	overrides := map[string]string{"CGO_ENABLED": cgoEnabled}
+	if target.GOOS != "" {
+		overrides["GOOS"] = target.GOOS
+	}
+	if target.GOARCH != "" {
+		overrides["GOARCH"] = target.GOARCH
+	}
+
+	result := make([]string, 0, len(env)+len(overrides))
+	for _, kv := range env {
+		key := strings.SplitN(kv, "=", 2)[0]
+		if _, overridden := overrides[key]; overridden {
+			continue
+		}
+		result = append(result, kv)
+	}
+	for _, key := range []string{"GOOS", "GOARCH", "CGO_ENABLED"} {
+		if val, ok := overrides[key]; ok {
+			result = append(result, key+"="+val)
+		}
+	}
+	return result
+}
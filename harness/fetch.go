@@ -0,0 +1,89 @@
+package harness
+
+import (
+	"github.com/robfig/revel"
+	"golang.org/x/tools/go/vcs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// missingImports returns every import path reported as missing in output,
+// not just the first, so all of them can be resolved (or reported)
+// together.
+func missingImports(output []byte) []string {
+	var imports []string
+	for _, m := range importErrorPattern.FindAllStringSubmatch(string(output), -1) {
+		imports = append(imports, m[1])
+	}
+	return imports
+}
+
+// fetchImport discovers the real repository root for importPath via
+// RepoRootForImportPath and checks it out into the first GOPATH entry
+// using whatever VCS (git/hg/svn) the host requires. It returns the
+// resolved repo root so the caller can avoid retrying every subpackage a
+// single repo exposes.
+func fetchImport(importPath string, env []string) (repoRoot string, err error) {
+	root, err := vcs.RepoRootForImportPath(importPath, false)
+	if err != nil {
+		return "", err
+	}
+
+	dest := filepath.Join(firstGopath(env), "src", root.Root)
+	if info, statErr := os.Stat(dest); statErr == nil && info.IsDir() {
+		// Already checked out, e.g. by a sibling subpackage of this repo.
+		return root.Root, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return root.Root, err
+	}
+
+	// The vcs package runs its command with the process environment, so
+	// apply env's differing entries there for the duration of the checkout.
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || os.Getenv(parts[0]) == parts[1] {
+			continue
+		}
+		if old, had := os.LookupEnv(parts[0]); had {
+			defer os.Setenv(parts[0], old)
+		} else {
+			defer os.Unsetenv(parts[0])
+		}
+		os.Setenv(parts[0], parts[1])
+	}
+
+	revel.TRACE.Println("Fetching", root.Root, "via", root.VCS.Cmd, "from", root.Repo)
+	return root.Root, root.VCS.Create(dest, root.Repo)
+}
+
+// firstGopath returns the first entry of the GOPATH set in env, falling
+// back to the GOPATH inherited from the current process.
+func firstGopath(env []string) string {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "GOPATH=") {
+			return strings.SplitN(strings.TrimPrefix(kv, "GOPATH="), string(filepath.ListSeparator), 2)[0]
+		}
+	}
+	return strings.SplitN(os.Getenv("GOPATH"), string(filepath.ListSeparator), 2)[0]
+}
+
+// vcsAuthEnv appends VCS auth overrides configured via app.conf to env,
+// scoped to the fetch subprocess rather than touching the user's global
+// VCS config. With nothing configured, the VCS tool falls back to its own
+// defaults (an existing ~/.netrc, SSH agent, etc).
+func vcsAuthEnv(env []string) []string {
+	if key, found := revel.Config.String("build.vcs.ssh_key"); found && key != "" {
+		env = append(env, "GIT_SSH_COMMAND=ssh -i "+key+" -o IdentitiesOnly=yes")
+	}
+	if token, found := revel.Config.String("build.vcs.token"); found && token != "" {
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=url.https://"+token+"@github.com/.insteadOf",
+			"GIT_CONFIG_VALUE_0=https://github.com/",
+		)
+	}
+	return env
+}
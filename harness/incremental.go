@@ -0,0 +1,150 @@
+package harness
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/robfig/revel"
+	"golang.org/x/tools/go/packages"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// buildCache holds state from the previous Build invocation. Watched
+// dev-mode rebuilds call Build repeatedly as files change; reusing cached
+// work when nothing relevant changed avoids re-parsing the app and
+// rewriting tmp/main.go on every request.
+var buildCache struct {
+	mainGoSource string
+}
+
+// packageCacheEntry is the cached ProcessSource result for a single
+// package directory, valid as long as signature matches that directory's
+// current contents.
+type packageCacheEntry struct {
+	signature  string
+	sourceInfo *SourceInfo
+}
+
+// packageCache holds one entry per package directory discovered under
+// revel.CodePaths, so a rebuild only re-parses the packages whose files
+// actually changed instead of rescanning the whole app.
+var packageCache = make(map[string]*packageCacheEntry)
+
+// discoverPackageDirs resolves every package directory reachable from
+// codePaths using golang.org/x/tools/go/packages, giving per-package
+// granularity for the caching in processSourceCached below. It only needs
+// each package's name and file list to do that, so the load is restricted
+// to NeedName|NeedFiles: pulling in NeedSyntax/NeedTypes/NeedDeps would
+// typecheck the whole app and its dependencies on every watched rebuild,
+// which is the full-rescan cost this cache exists to avoid. Returns nil if
+// go/packages itself fails to load the tree, so the caller can fall back
+// to a plain ProcessSource pass and let that report the error as before.
+// Packages that load with errors (e.g. ones that don't compile) are still
+// listed, and their parse errors surface from ProcessSource.
+func discoverPackageDirs(codePaths []string) []string {
+	patterns := make([]string, len(codePaths))
+	for i, p := range codePaths {
+		patterns[i] = p + "/..."
+	}
+
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles,
+		Dir:  revel.BasePath,
+	}
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		revel.TRACE.Println("go/packages load failed, falling back to a full rescan:", err)
+		return nil
+	}
+
+	dirSet := make(map[string]struct{})
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		for _, f := range pkg.GoFiles {
+			dirSet[filepath.Dir(f)] = struct{}{}
+		}
+	})
+
+	dirs := make([]string, 0, len(dirSet))
+	for dir := range dirSet {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// packageSignature fingerprints a single package directory's .go files by
+// name, modification time, and size.
+func packageSignature(dir string) string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	h := sha1.New()
+	for _, info := range entries {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".go") {
+			continue
+		}
+		io.WriteString(h, info.Name())
+		io.WriteString(h, info.ModTime().String())
+		io.WriteString(h, strconv.FormatInt(info.Size(), 10))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// processSourceCached returns the SourceInfo for codePaths, re-running
+// ProcessSource only for the package directories whose signature changed
+// since the last build and reusing packageCache for the rest.
+func processSourceCached(codePaths []string) (*SourceInfo, *revel.Error) {
+	dirs := discoverPackageDirs(codePaths)
+	if len(dirs) == 0 {
+		return ProcessSource(codePaths)
+	}
+
+	var merged *SourceInfo
+	for _, dir := range dirs {
+		sig := packageSignature(dir)
+
+		if entry, ok := packageCache[dir]; ok && entry.signature == sig {
+			merged = mergeSourceInfo(merged, entry.sourceInfo)
+			continue
+		}
+
+		info, compileError := ProcessSource([]string{dir})
+		if compileError != nil {
+			return nil, compileError
+		}
+		packageCache[dir] = &packageCacheEntry{signature: sig, sourceInfo: info}
+		merged = mergeSourceInfo(merged, info)
+	}
+	return merged, nil
+}
+
+// mergeSourceInfo combines a package's SourceInfo into the accumulated
+// result, always returning a SourceInfo distinct from any cached entry so
+// callers are free to mutate the result (e.g. appending db.import) without
+// corrupting packageCache.
+func mergeSourceInfo(acc, next *SourceInfo) *SourceInfo {
+	if acc == nil {
+		acc = &SourceInfo{}
+	}
+	if next == nil {
+		return acc
+	}
+	acc.ControllerSpecs = append(acc.ControllerSpecs, next.ControllerSpecs...)
+	acc.TestSuites = append(acc.TestSuites, next.TestSuites...)
+	acc.InitImportPaths = append(acc.InitImportPaths, next.InitImportPaths...)
+	if len(next.ValidationKeys) > 0 {
+		if acc.ValidationKeys == nil {
+			acc.ValidationKeys = make(map[string]map[int]string, len(next.ValidationKeys))
+		}
+		for path, keys := range next.ValidationKeys {
+			acc.ValidationKeys[path] = keys
+		}
+	}
+	return acc
+}